@@ -41,8 +41,33 @@ const (
 
 	// Maximum number of semaphores in all semaphore sets.
 	semsTotalMax = linux.SEMMNS
+
+	// seqMax bounds the IPC sequence number handed out by Registry.newSet,
+	// so that seq*setsMax (see idFor) never overflows a positive int32.
+	seqMax = (1<<31 - 1) / setsMax
 )
 
+// idFor returns the identifier newSet should hand out for a set at the
+// given index with the given IPC sequence number, following the scheme
+// Linux's ipc_buildid uses: id modulo setsMax selects the index, and id
+// divided by setsMax is a generation count that changes every time the index
+// is reused,
+// so a semget/IPC_RMID/semget cycle at the same index never hands out the
+// same identifier twice (modulo wraparound of seq, as in Linux).
+func idFor(seq, index int32) int32 {
+	return seq*setsMax + index
+}
+
+// indexOfID returns the index encoded in id by idFor.
+func indexOfID(id int32) int32 {
+	return id % setsMax
+}
+
+// seqOfID returns the IPC sequence number encoded in id by idFor.
+func seqOfID(id int32) int32 {
+	return id / setsMax
+}
+
 // Registry maintains a set of semaphores that can be found by key or ID.
 //
 // +stateify savable
@@ -50,12 +75,97 @@ type Registry struct {
 	// userNS owning the ipc name this registry belongs to. Immutable.
 	userNS *auth.UserNamespace
 	// mu protects all fields below.
-	mu         sync.Mutex `state:"nosave"`
-	semaphores map[int32]*Set
-	lastIDUsed int32
-	// indexes maintains a mapping between a set's index in virtual array and
-	// its identifier.
-	indexes map[int32]int32
+	mu sync.Mutex `state:"nosave"`
+	// sets holds the live Set at each in-use index, keyed by index (not
+	// by the full identifier returned to callers, which also encodes a
+	// generation number; see idFor).
+	sets map[int32]*Set
+	// keys is a reverse index from a set's user-provided key to the Set
+	// with that key, for FindOrCreate's non-private lookups. A set
+	// created with key == linux.IPC_PRIVATE is never entered here, since
+	// IPC_PRIVATE isn't a real key to look anything up by (semget always
+	// creates a new set for it; see newSet).
+	keys map[int32]*Set
+	// seq is the IPC sequence number mixed into the identifier newSet
+	// handed out most recently. newSet increments it (mod seqMax) before
+	// every set creation and uses the new value, matching Linux's
+	// per-namespace ids->seq counter.
+	seq int32
+	// freeIndexes holds indexes freed by a removed set, available for
+	// immediate reuse, and nextIndex is the smallest index that has
+	// never been allocated. Together they make index allocation O(1)
+	// amortized instead of a linear scan over setsMax; see allocateIndex.
+	freeIndexes []int32
+	nextIndex   int32
+	// highestIndex is the highest index currently in use by a live set, or
+	// -1 if no set is live, matching Linux's ipc_ids.max_idx semantics; see
+	// freeIndex.
+	highestIndex int32
+
+	// hooks is consulted, in addition to the DAC checks in checkPerms,
+	// before associating with, operating on, or administering any set in
+	// this registry. It defaults to noopSecurityHooks{}; see
+	// SetSecurityHooks. Unlike the other fields above, hooks is not
+	// protected by mu: SetSecurityHooks is meant to be called once, to
+	// configure r, before r is shared with any goroutine that might
+	// operate on its sets.
+	hooks SecurityHooks
+}
+
+// SecurityHooks lets a security module participate in semaphore operations,
+// mirroring the per-object check and label hooks of the TrustedBSD MAC
+// framework (see the mac_sysvsem_check_* entry points wired into FreeBSD's
+// sysv_sem.c). A Registry calls these in addition to, and after, its own DAC
+// checkPerms check; returning a non-nil error fails the syscall with that
+// error instead of proceeding.
+type SecurityHooks interface {
+	// Create is called once a new set has been fully initialized, before
+	// it's returned to the caller that created it. It may populate the
+	// set's securityLabel.
+	Create(ctx context.Context, set *Set) error
+
+	// Cleanup is called after set has been removed from its registry and
+	// is no longer reachable by key or ID.
+	Cleanup(set *Set)
+
+	// CheckAssociate is called when a process looks up or creates set via
+	// semget: for an existing set after checkPerms succeeds, and for a newly
+	// created set after Create succeeds.
+	CheckAssociate(ctx context.Context, set *Set, mode linux.FileMode) error
+
+	// CheckSemop is called before a semop batch is applied to set, after
+	// checkPerms succeeds.
+	CheckSemop(ctx context.Context, set *Set, ops []linux.Sembuf) error
+
+	// CheckSemctl is called before a semctl command is carried out
+	// against set, after checkPerms succeeds. cmd is one of the semctl(2)
+	// command constants (e.g. linux.IPC_STAT, linux.SETVAL).
+	CheckSemctl(ctx context.Context, set *Set, cmd int32) error
+}
+
+// noopSecurityHooks is the default SecurityHooks: every check passes and
+// every lifecycle callback does nothing, so behavior is unchanged until a
+// caller registers something else via SetSecurityHooks.
+type noopSecurityHooks struct{}
+
+func (noopSecurityHooks) Create(context.Context, *Set) error { return nil }
+func (noopSecurityHooks) Cleanup(*Set)                       {}
+func (noopSecurityHooks) CheckAssociate(context.Context, *Set, linux.FileMode) error {
+	return nil
+}
+func (noopSecurityHooks) CheckSemop(context.Context, *Set, []linux.Sembuf) error { return nil }
+func (noopSecurityHooks) CheckSemctl(context.Context, *Set, int32) error         { return nil }
+
+// SetSecurityHooks installs hooks to be consulted for every subsequent
+// operation against sets in r. Passing nil restores the no-op default.
+//
+// SetSecurityHooks must be called before r is shared with any goroutine
+// that might concurrently look up or operate on one of its sets.
+func (r *Registry) SetSecurityHooks(hooks SecurityHooks) {
+	if hooks == nil {
+		hooks = noopSecurityHooks{}
+	}
+	r.hooks = hooks
 }
 
 // Set represents a set of semaphores that can be operated atomically.
@@ -74,50 +184,201 @@ type Set struct {
 	// creator is the user that created the set. Immutable.
 	creator fs.FileOwner
 
-	// mu protects all fields below.
-	mu         sync.Mutex `state:"nosave"`
-	owner      fs.FileOwner
-	perms      fs.FilePermissions
-	opTime     ktime.Time
-	changeTime ktime.Time
-
-	// sems holds all semaphores in the set. The slice itself is immutable after
-	// it's been set, however each 'sem' object in the slice requires 'mu' lock.
+	// mu is the set's "complex operation" lock, following the design of
+	// Manfred Spraul's threaded ipc/sem.c patches: an operation whose
+	// Sembuf entries all reference the same semaphore only takes mu for
+	// reading, plus that one semaphore's own lock (see sem.mu below), so
+	// unrelated simple operations on different semaphores in the same set
+	// run concurrently. An operation that may affect more than one
+	// semaphore (a multi-sem batch, SETALL, IPC_RMID, Change) takes mu
+	// for writing, which excludes every concurrent simple operation.
+	//
+	// mu protects owner, perms, dead, pending and complexCount. sems,
+	// bookkeepingMu and undo are protected separately; see their comments.
+	mu    sync.RWMutex `state:"nosave"`
+	owner fs.FileOwner
+	perms fs.FilePermissions
+	dead  bool
+
+	// bookkeepingMu protects opTime, changeTime and the membership of the
+	// undo map (i.e. which SemUndoLists have an entry, as opposed to the
+	// contents of any one entry, which is protected by that
+	// SemUndoList's own mu). These are touched by every successful
+	// operation, including simple ones that only hold mu for reading, so
+	// they need a lock of their own instead of riding along on mu or on
+	// any single semaphore's lock.
+	//
+	// Lock ordering: mu (or a semaphore's lock) is always acquired before
+	// bookkeepingMu, which is always acquired before any SemUndoList's mu.
+	bookkeepingMu sync.Mutex `state:"nosave"`
+	opTime        ktime.Time
+	changeTime    ktime.Time
+
+	// undo tracks the outstanding SEM_UNDO adjustment owed to each
+	// SemUndoList that has performed a SEM_UNDO operation against this
+	// set. Entries are mirrored in the corresponding SemUndoList.entries.
+	// Membership (adding/removing/ranging over keys) is protected by
+	// bookkeepingMu; the []int16 an entry points to is protected by that
+	// list's own mu.
+	undo map[*SemUndoList][]int16
+
+	// sems holds all semaphores in the set. The slice itself is immutable
+	// after it's been set; each sem's own fields are protected by that
+	// sem's mu, as described above.
 	sems []sem
 
-	// dead is set to true when the set is removed and can't be reached anymore.
-	// All waiters must wake up and fail when set is dead.
-	dead bool
+	// pending holds every complex (multi-semaphore) batch of operations
+	// currently blocked against this set, in the order they arrived, and
+	// is protected by mu. Blocked simple (single-semaphore) batches are
+	// queued only on their one semaphore's own waiters list instead,
+	// since mutating a list shared by the whole set isn't safe under the
+	// fast path's semaphore-local lock; see retryPendingLocked.
+	pending pendingList `state:"zerovalue"`
+
+	// complexCount is the number of pending waiters whose batch
+	// references more than one semaphore, protected by mu. A simple
+	// operation observes it (while holding mu for reading) to decide
+	// whether it's safe to take the fast, semaphore-local path: if it's
+	// nonzero, a complex waiter might be blocked on the very semaphore
+	// the simple operation is about to touch, so the operation falls
+	// back to the exclusive path to preserve FIFO ordering against it.
+	complexCount int32
+
+	// securityLabel is an opaque label a registered SecurityHooks
+	// implementation may attach at creation time (in its Create callback)
+	// and consult on later checks, mirroring the per-object label storage
+	// of the TrustedBSD MAC framework. The semaphore package itself never
+	// reads or writes it.
+	securityLabel interface{}
 }
 
 // sem represents a single semaphore from a set.
 //
 // +stateify savable
 type sem struct {
-	value   int16
+	// mu protects value, pid and waiters against concurrent simple
+	// operations on this one semaphore. A caller always holds at least
+	// Set.mu.RLock() (or Set.mu.Lock(), for a complex operation) when
+	// taking mu.
+	mu    sync.Mutex `state:"nosave"`
+	value int16
+	pid   int32
+
+	// waiters holds a waiterRef for every pending waiter with an
+	// operation against this semaphore, including complex waiters (for
+	// CountZeroWaiters/CountNegativeWaiters' benefit). For a simple
+	// waiter, this list doubles as the authoritative queue
+	// retryPendingLocked's fast path scans; a complex waiter is only
+	// ever retried via Set.pending.
 	waiters waiterList `state:"zerovalue"`
-	pid     int32
 }
 
-// waiter represents a caller that is waiting for the semaphore value to
-// become positive or zero.
+// waiterRef is a single semaphore's link back to a pending waiter batch
+// that includes an operation against it.
 //
 // +stateify savable
-type waiter struct {
+type waiterRef struct {
 	waiterEntry
 
-	// value represents how much resource the waiter needs to wake up.
-	// The value is either 0 or negative.
+	sem *sem
+	w   *waiter
+
+	// value mirrors the SemOp of the operation this semaphore is
+	// participating in: 0 for "wait for zero", negative for "wait for
+	// resources".
 	value int16
-	ch    chan struct{}
+}
+
+// waiter represents a whole batch of semaphore operations that couldn't be
+// applied immediately and is waiting to be retried.
+//
+// +stateify savable
+type waiter struct {
+	pendingEntry
+
+	ops      []linux.Sembuf
+	pid      int32
+	undoList *SemUndoList
+
+	// complex is true if ops references more than one distinct
+	// semaphore.
+	complex bool
+
+	// refs holds the waiterRef linked into each semaphore ops touches,
+	// so they can all be unlinked together when the batch is resolved.
+	refs []*waiterRef
+
+	ch chan struct{}
+}
+
+// undoEntry records the SEM_UNDO adjustment owed to a single semaphore set
+// by a SemUndoList. adjustments[i] is the amount that must be added to
+// sems[i].value to undo every SEM_UNDO operation applied so far through
+// this list.
+//
+// +stateify savable
+type undoEntry struct {
+	setID       int32
+	adjustments []int16
+}
+
+// SemUndoList tracks the pending SEM_UNDO adjustments for a single
+// "undo-list identifier", i.e. the set of thread groups that share undo
+// state because they were created with CLONE_SYSVSEM. Callers are expected
+// to replace a task's SemUndoList with a new, empty one on execve, matching
+// Linux's sem_undo_list semantics.
+//
+// +stateify savable
+type SemUndoList struct {
+	// mu protects entries.
+	mu sync.Mutex `state:"nosave"`
+
+	// entries holds one entry per semaphore set this list has an
+	// outstanding adjustment against.
+	entries []undoEntry
+}
+
+// NewSemUndoList returns a new, empty SemUndoList.
+func NewSemUndoList() *SemUndoList {
+	return &SemUndoList{}
+}
+
+// Exit applies every adjustment accumulated by l and forgets about them. It
+// must be called when the last thread group referencing l exits.
+func (l *SemUndoList) Exit(ctx context.Context, reg *Registry, pid int32) {
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = nil
+	l.mu.Unlock()
+
+	for _, e := range entries {
+		if set := reg.FindByID(e.setID); set != nil {
+			set.applyExitUndo(ctx, l, e.adjustments, pid)
+		}
+	}
+}
+
+// removeLocked forgets about any adjustment owed to the set with the given
+// ID.
+//
+// Preconditions: l.mu is locked.
+func (l *SemUndoList) removeLocked(setID int32) {
+	for i := range l.entries {
+		if l.entries[i].setID == setID {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			return
+		}
+	}
 }
 
 // NewRegistry creates a new semaphore set registry.
 func NewRegistry(userNS *auth.UserNamespace) *Registry {
 	return &Registry{
-		userNS:     userNS,
-		semaphores: make(map[int32]*Set),
-		indexes:    make(map[int32]int32),
+		userNS:       userNS,
+		sets:         make(map[int32]*Set),
+		keys:         make(map[int32]*Set),
+		hooks:        noopSecurityHooks{},
+		highestIndex: -1,
 	}
 }
 
@@ -145,6 +406,9 @@ func (r *Registry) FindOrCreate(ctx context.Context, key, nsems int32, mode linu
 			if !set.checkPerms(creds, fs.PermsFromMode(mode)) {
 				return nil, linuxerr.EACCES
 			}
+			if err := r.hooks.CheckAssociate(ctx, set, mode); err != nil {
+				return nil, err
+			}
 
 			// Validate parameters.
 			if nsems > int32(set.Size()) {
@@ -168,10 +432,7 @@ func (r *Registry) FindOrCreate(ctx context.Context, key, nsems int32, mode linu
 	}
 
 	// Apply system limits.
-	//
-	// Map semaphores and map indexes in a registry are of the same size,
-	// check map semaphores only here for the system limit.
-	if len(r.semaphores) >= setsMax {
+	if len(r.sets) >= setsMax {
 		return nil, syserror.ENOSPC
 	}
 	if r.totalSems() > int(semsTotalMax-nsems) {
@@ -181,7 +442,21 @@ func (r *Registry) FindOrCreate(ctx context.Context, key, nsems int32, mode linu
 	// Finally create a new set.
 	owner := fs.FileOwnerFromContext(ctx)
 	perms := fs.FilePermsFromMode(mode)
-	return r.newSet(ctx, key, owner, owner, perms, nsems)
+	set, err := r.newSet(ctx, key, owner, owner, perms, nsems)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.hooks.Create(ctx, set); err != nil {
+		r.removeLocked(set)
+		r.hooks.Cleanup(set)
+		return nil, err
+	}
+	if err := r.hooks.CheckAssociate(ctx, set, mode); err != nil {
+		r.removeLocked(set)
+		r.hooks.Cleanup(set)
+		return nil, err
+	}
+	return set, nil
 }
 
 // IPCInfo returns information about system-wide semaphore limits and parameters.
@@ -208,7 +483,7 @@ func (r *Registry) SemInfo() *linux.SemInfo {
 	defer r.mu.Unlock()
 
 	info := r.IPCInfo()
-	info.SemUsz = uint32(len(r.semaphores))
+	info.SemUsz = uint32(len(r.sets))
 	info.SemAem = uint32(r.totalSems())
 
 	return info
@@ -220,32 +495,22 @@ func (r *Registry) HighestIndex() int32 {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// By default, highest used index is 0 even though
-	// there is no semaphore set.
-	var highestIndex int32
-	for index := range r.indexes {
-		if index > highestIndex {
-			highestIndex = index
-		}
-	}
-	return highestIndex
+	// highestIndex is maintained by allocateIndex and freeIndex as indexes
+	// are handed out and returned, so this is O(1) rather than a scan over
+	// r.sets.
+	return r.highestIndex
 }
 
 // RemoveID removes set with give 'id' from the registry and marks the set as
 // dead. All waiters will be awakened and fail.
-func (r *Registry) RemoveID(id int32, creds *auth.Credentials) error {
+func (r *Registry) RemoveID(ctx context.Context, id int32, creds *auth.Credentials) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	set := r.semaphores[id]
+	set := r.findByIDLocked(id)
 	if set == nil {
 		return linuxerr.EINVAL
 	}
-	index, found := r.findIndexByID(id)
-	if !found {
-		// Inconsistent state.
-		panic(fmt.Sprintf("unable to find an index for ID: %d", id))
-	}
 
 	set.mu.Lock()
 	defer set.mu.Unlock()
@@ -255,16 +520,41 @@ func (r *Registry) RemoveID(id int32, creds *auth.Credentials) error {
 	if !set.checkCredentials(creds) && !set.checkCapability(creds) {
 		return linuxerr.EACCES
 	}
+	if err := r.hooks.CheckSemctl(ctx, set, linux.IPC_RMID); err != nil {
+		return err
+	}
 
-	delete(r.semaphores, set.ID)
-	delete(r.indexes, index)
+	r.removeLocked(set)
 	set.destroy()
+	r.hooks.Cleanup(set)
 	return nil
 }
 
+// removeLocked removes set from every Registry structure that references it
+// by index or key, without destroying it or invoking any security hook; the
+// caller is responsible for both.
+//
+// Preconditions: r.mu is locked.
+func (r *Registry) removeLocked(set *Set) {
+	index := indexOfID(set.ID)
+	delete(r.sets, index)
+	if set.key != linux.IPC_PRIVATE {
+		delete(r.keys, set.key)
+	}
+	r.freeIndex(index)
+}
+
 func (r *Registry) newSet(ctx context.Context, key int32, owner, creator fs.FileOwner, perms fs.FilePermissions, nsems int32) (*Set, error) {
+	index, found := r.allocateIndex()
+	if !found {
+		log.Warningf("Semaphore map is full, they must be leaking")
+		return nil, syserror.ENOMEM
+	}
+
+	r.seq = (r.seq + 1) % seqMax
 	set := &Set{
 		registry:   r,
+		ID:         idFor(r.seq, index),
 		key:        key,
 		owner:      owner,
 		creator:    owner,
@@ -272,80 +562,93 @@ func (r *Registry) newSet(ctx context.Context, key int32, owner, creator fs.File
 		changeTime: ktime.NowFromContext(ctx),
 		sems:       make([]sem, nsems),
 	}
+	r.sets[index] = set
+	if key != linux.IPC_PRIVATE {
+		r.keys[key] = set
+	}
+	return set, nil
+}
 
-	// Find the next available ID.
-	for id := r.lastIDUsed + 1; id != r.lastIDUsed; id++ {
-		// Handle wrap around.
-		if id < 0 {
-			id = 0
-			continue
-		}
-		if r.semaphores[id] == nil {
-			index, found := r.findFirstAvailableIndex()
-			if !found {
-				panic("unable to find an available index")
-			}
-			r.indexes[index] = id
-			r.lastIDUsed = id
-			r.semaphores[id] = set
-			set.ID = id
-			return set, nil
+// allocateIndex returns an index not currently in use by any set, and true,
+// or false if setsMax indexes are already live. It prefers reusing an index
+// freed by a prior removal (O(1) pop from freeIndexes) before handing out a
+// never-before-used one, so allocation never has to scan r.sets.
+func (r *Registry) allocateIndex() (int32, bool) {
+	if n := len(r.freeIndexes); n > 0 {
+		index := r.freeIndexes[n-1]
+		r.freeIndexes = r.freeIndexes[:n-1]
+		if index > r.highestIndex {
+			r.highestIndex = index
 		}
+		return index, true
 	}
+	if r.nextIndex >= setsMax {
+		return 0, false
+	}
+	index := r.nextIndex
+	r.nextIndex++
+	if index > r.highestIndex {
+		r.highestIndex = index
+	}
+	return index, true
+}
 
-	log.Warningf("Semaphore map is full, they must be leaking")
-	return nil, syserror.ENOMEM
+// freeIndex returns index, previously removed from r.sets and previously
+// returned by allocateIndex, to the free list for reuse. If index was the
+// highest currently in use, it also lowers highestIndex to the next index
+// still live, or -1 if none is, mirroring the walk ipc_rmid does down from
+// ipc_ids.max_idx.
+//
+// Preconditions: index is no longer a key of r.sets.
+func (r *Registry) freeIndex(index int32) {
+	r.freeIndexes = append(r.freeIndexes, index)
+	if index != r.highestIndex {
+		return
+	}
+	for r.highestIndex >= 0 {
+		if _, ok := r.sets[r.highestIndex]; ok {
+			break
+		}
+		r.highestIndex--
+	}
 }
 
-// FindByID looks up a set given an ID.
+// FindByID looks up a set given an ID, rejecting a stale ID (one whose
+// generation doesn't match the one currently assigned to its index, e.g.
+// because the set it used to name was removed and the index reused) by
+// returning nil exactly as if no set had ever existed with that ID.
 func (r *Registry) FindByID(id int32) *Set {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	return r.semaphores[id]
+	return r.findByIDLocked(id)
+}
+
+func (r *Registry) findByIDLocked(id int32) *Set {
+	set, present := r.sets[indexOfID(id)]
+	if !present || seqOfID(set.ID) != seqOfID(id) {
+		return nil
+	}
+	return set
 }
 
 // FindByIndex looks up a set given an index.
 func (r *Registry) FindByIndex(index int32) *Set {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-
-	id, present := r.indexes[index]
-	if !present {
-		return nil
-	}
-	return r.semaphores[id]
+	return r.sets[index]
 }
 
+// findByKey looks up a set by its user-provided key via the keys reverse
+// index, so callers (FindOrCreate) don't have to scan every live set.
+// key == linux.IPC_PRIVATE never matches, since private sets aren't entered
+// into r.keys; see newSet.
 func (r *Registry) findByKey(key int32) *Set {
-	for _, v := range r.semaphores {
-		if v.key == key {
-			return v
-		}
-	}
-	return nil
-}
-
-func (r *Registry) findIndexByID(id int32) (int32, bool) {
-	for k, v := range r.indexes {
-		if v == id {
-			return k, true
-		}
-	}
-	return 0, false
-}
-
-func (r *Registry) findFirstAvailableIndex() (int32, bool) {
-	for index := int32(0); index < setsMax; index++ {
-		if _, present := r.indexes[index]; !present {
-			return index, true
-		}
-	}
-	return 0, false
+	return r.keys[key]
 }
 
 func (r *Registry) totalSems() int {
 	totalSems := 0
-	for _, v := range r.semaphores {
+	for _, v := range r.sets {
 		totalSems += v.Size()
 	}
 	return totalSems
@@ -363,7 +666,8 @@ func (s *Set) Size() int {
 	return len(s.sems)
 }
 
-// Change changes some fields from the set atomically.
+// Change changes some fields from the set atomically. This affects every
+// semaphore in the set, so it always takes the exclusive lock.
 func (s *Set) Change(ctx context.Context, creds *auth.Credentials, owner fs.FileOwner, perms fs.FilePermissions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -373,31 +677,46 @@ func (s *Set) Change(ctx context.Context, creds *auth.Credentials, owner fs.File
 	if !s.checkCredentials(creds) && !s.checkCapability(creds) {
 		return linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.IPC_SET); err != nil {
+		return err
+	}
 
 	s.owner = owner
 	s.perms = perms
+	s.bookkeepingMu.Lock()
 	s.changeTime = ktime.NowFromContext(ctx)
+	s.bookkeepingMu.Unlock()
 	return nil
 }
 
 // GetStat extracts semid_ds information from the set.
-func (s *Set) GetStat(creds *auth.Credentials) (*linux.SemidDS, error) {
+func (s *Set) GetStat(ctx context.Context, creds *auth.Credentials) (*linux.SemidDS, error) {
 	// "The calling process must have read permission on the semaphore set."
-	return s.semStat(creds, fs.PermMask{Read: true})
+	return s.semStat(ctx, creds, fs.PermMask{Read: true})
 }
 
 // GetStatAny extracts semid_ds information from the set without requiring read access.
-func (s *Set) GetStatAny(creds *auth.Credentials) (*linux.SemidDS, error) {
-	return s.semStat(creds, fs.PermMask{})
+func (s *Set) GetStatAny(ctx context.Context, creds *auth.Credentials) (*linux.SemidDS, error) {
+	return s.semStat(ctx, creds, fs.PermMask{})
 }
 
-func (s *Set) semStat(creds *auth.Credentials, permMask fs.PermMask) (*linux.SemidDS, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Set) semStat(ctx context.Context, creds *auth.Credentials, permMask fs.PermMask) (*linux.SemidDS, error) {
+	// semStat doesn't mutate anything, so it only needs to exclude Change
+	// (the only thing that mutates owner/perms); it doesn't need to
+	// exclude concurrent simple operations on individual semaphores.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	if !s.checkPerms(creds, permMask) {
 		return nil, linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.IPC_STAT); err != nil {
+		return nil, err
+	}
+
+	s.bookkeepingMu.Lock()
+	opTime, changeTime := s.opTime, s.changeTime
+	s.bookkeepingMu.Unlock()
 
 	return &linux.SemidDS{
 		SemPerm: linux.IPCPerm{
@@ -407,38 +726,69 @@ func (s *Set) semStat(creds *auth.Credentials, permMask fs.PermMask) (*linux.Sem
 			CUID: uint32(creds.UserNamespace.MapFromKUID(s.creator.UID)),
 			CGID: uint32(creds.UserNamespace.MapFromKGID(s.creator.GID)),
 			Mode: uint16(s.perms.LinuxMode()),
-			Seq:  0, // IPC sequence not supported.
+			Seq:  uint16(seqOfID(s.ID)),
 		},
-		SemOTime: s.opTime.TimeT(),
-		SemCTime: s.changeTime.TimeT(),
+		SemOTime: opTime.TimeT(),
+		SemCTime: changeTime.TimeT(),
 		SemNSems: uint64(s.Size()),
 	}, nil
 }
 
-// SetVal overrides a semaphore value, waking up waiters as needed.
+// SetVal overrides a semaphore value, waking up waiters as needed. SETVAL
+// only ever touches a single semaphore, so unlike SetValAll it's eligible
+// for the simple, semaphore-local fast path; see Set.mu.
 func (s *Set) SetVal(ctx context.Context, num int32, val int16, creds *auth.Credentials, pid int32) error {
 	if val < 0 || val > valueMax {
 		return syserror.ERANGE
 	}
 
+	if num >= 0 && int(num) < s.Size() {
+		s.mu.RLock()
+		if s.complexCount == 0 {
+			sem := &s.sems[num]
+			sem.mu.Lock()
+			err := s.setValLocked(ctx, num, val, creds, pid)
+			sem.mu.Unlock()
+			s.mu.RUnlock()
+			return err
+		}
+		s.mu.RUnlock()
+		// A complex waiter is pending; fall back to the exclusive path so
+		// FIFO ordering against it is preserved.
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.setValLocked(ctx, num, val, creds, pid)
+}
 
+// setValLocked is the core of SetVal.
+//
+// Preconditions: the caller holds whatever lock is necessary to safely
+// mutate semaphore num: either Set.mu.RLock() plus that semaphore's own mu,
+// or Set.mu.Lock().
+func (s *Set) setValLocked(ctx context.Context, num int32, val int16, creds *auth.Credentials, pid int32) error {
 	// "The calling process must have alter permission on the semaphore set."
 	if !s.checkPerms(creds, fs.PermMask{Write: true}) {
 		return linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.SETVAL); err != nil {
+		return err
+	}
 
 	sem := s.findSem(num)
 	if sem == nil {
 		return syserror.ERANGE
 	}
 
-	// TODO(gvisor.dev/issue/137): Clear undo entries in all processes.
+	s.bookkeepingMu.Lock()
+	s.clearUndoLocked(num)
+	s.changeTime = ktime.NowFromContext(ctx)
+	s.bookkeepingMu.Unlock()
+
 	sem.value = val
 	sem.pid = pid
-	s.changeTime = ktime.NowFromContext(ctx)
-	sem.wakeWaiters()
+	s.retryPendingLocked(num)
 	return nil
 }
 
@@ -457,6 +807,8 @@ func (s *Set) SetValAll(ctx context.Context, vals []uint16, creds *auth.Credenti
 		}
 	}
 
+	// SETALL touches every semaphore in the set, so it always takes the
+	// exclusive lock.
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -464,86 +816,131 @@ func (s *Set) SetValAll(ctx context.Context, vals []uint16, creds *auth.Credenti
 	if !s.checkPerms(creds, fs.PermMask{Write: true}) {
 		return linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.SETALL); err != nil {
+		return err
+	}
 
+	s.bookkeepingMu.Lock()
 	for i, val := range vals {
 		sem := &s.sems[i]
 
-		// TODO(gvisor.dev/issue/137): Clear undo entries in all processes.
+		s.clearUndoLocked(int32(i))
 		sem.value = int16(val)
 		sem.pid = pid
-		sem.wakeWaiters()
 	}
 	s.changeTime = ktime.NowFromContext(ctx)
+	s.bookkeepingMu.Unlock()
+	// SETALL can affect every semaphore in the set, so a full rescan of
+	// pending waiters is required rather than just sem i's own queue.
+	s.retryPendingLocked(-1)
 	return nil
 }
 
-// GetVal returns a semaphore value.
-func (s *Set) GetVal(num int32, creds *auth.Credentials) (int16, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// clearUndoLocked clears the pending undo adjustment for semaphore num in
+// every SemUndoList currently tracking this set. An explicit SETVAL/SETALL
+// override invalidates any previously accumulated undo delta for that
+// semaphore, as in Linux.
+//
+// Preconditions: s.bookkeepingMu is locked.
+func (s *Set) clearUndoLocked(num int32) {
+	for list, adj := range s.undo {
+		list.mu.Lock()
+		adj[num] = 0
+		list.mu.Unlock()
+	}
+}
+
+// GetVal returns a semaphore value. Like every other read-only accessor
+// below, it never needs to fall back to the exclusive path: it only ever
+// needs to exclude a concurrent writer of the one semaphore it reads, which
+// that semaphore's own mu already guarantees.
+func (s *Set) GetVal(ctx context.Context, num int32, creds *auth.Credentials) (int16, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	// "The calling process must have read permission on the semaphore set."
 	if !s.checkPerms(creds, fs.PermMask{Read: true}) {
 		return 0, linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.GETVAL); err != nil {
+		return 0, err
+	}
 
 	sem := s.findSem(num)
 	if sem == nil {
 		return 0, syserror.ERANGE
 	}
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
 	return sem.value, nil
 }
 
 // GetValAll returns value for all semaphores.
-func (s *Set) GetValAll(creds *auth.Credentials) ([]uint16, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Set) GetValAll(ctx context.Context, creds *auth.Credentials) ([]uint16, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	// "The calling process must have read permission on the semaphore set."
 	if !s.checkPerms(creds, fs.PermMask{Read: true}) {
 		return nil, linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.GETALL); err != nil {
+		return nil, err
+	}
 
 	vals := make([]uint16, s.Size())
-	for i, sem := range s.sems {
+	for i := range s.sems {
+		sem := &s.sems[i]
+		sem.mu.Lock()
 		vals[i] = uint16(sem.value)
+		sem.mu.Unlock()
 	}
 	return vals, nil
 }
 
 // GetPID returns the PID set when performing operations in the semaphore.
-func (s *Set) GetPID(num int32, creds *auth.Credentials) (int32, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Set) GetPID(ctx context.Context, num int32, creds *auth.Credentials) (int32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	// "The calling process must have read permission on the semaphore set."
 	if !s.checkPerms(creds, fs.PermMask{Read: true}) {
 		return 0, linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, linux.GETPID); err != nil {
+		return 0, err
+	}
 
 	sem := s.findSem(num)
 	if sem == nil {
 		return 0, syserror.ERANGE
 	}
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
 	return sem.pid, nil
 }
 
-func (s *Set) countWaiters(num int32, creds *auth.Credentials, pred func(w *waiter) bool) (uint16, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Set) countWaiters(ctx context.Context, num int32, creds *auth.Credentials, cmd int32, pred func(ref *waiterRef) bool) (uint16, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	// The calling process must have read permission on the semaphore set.
 	if !s.checkPerms(creds, fs.PermMask{Read: true}) {
 		return 0, linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemctl(ctx, s, cmd); err != nil {
+		return 0, err
+	}
 
 	sem := s.findSem(num)
 	if sem == nil {
 		return 0, syserror.ERANGE
 	}
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
 	var cnt uint16
-	for w := sem.waiters.Front(); w != nil; w = w.Next() {
-		if pred(w) {
+	for ref := sem.waiters.Front(); ref != nil; ref = ref.Next() {
+		if pred(ref) {
 			cnt++
 		}
 	}
@@ -551,16 +948,16 @@ func (s *Set) countWaiters(num int32, creds *auth.Credentials, pred func(w *wait
 }
 
 // CountZeroWaiters returns number of waiters waiting for the sem's value to increase.
-func (s *Set) CountZeroWaiters(num int32, creds *auth.Credentials) (uint16, error) {
-	return s.countWaiters(num, creds, func(w *waiter) bool {
-		return w.value == 0
+func (s *Set) CountZeroWaiters(ctx context.Context, num int32, creds *auth.Credentials) (uint16, error) {
+	return s.countWaiters(ctx, num, creds, linux.GETZCNT, func(ref *waiterRef) bool {
+		return ref.value == 0
 	})
 }
 
 // CountNegativeWaiters returns number of waiters waiting for the sem to go to zero.
-func (s *Set) CountNegativeWaiters(num int32, creds *auth.Credentials) (uint16, error) {
-	return s.countWaiters(num, creds, func(w *waiter) bool {
-		return w.value < 0
+func (s *Set) CountNegativeWaiters(ctx context.Context, num int32, creds *auth.Credentials) (uint16, error) {
+	return s.countWaiters(ctx, num, creds, linux.GETNCNT, func(ref *waiterRef) bool {
+		return ref.value < 0
 	})
 }
 
@@ -569,10 +966,68 @@ func (s *Set) CountNegativeWaiters(num int32, creds *auth.Credentials) (uint16,
 //
 // On failure, it may return an error (retries are hopeless) or it may return
 // a channel that can be waited on before attempting again.
-func (s *Set) ExecuteOps(ctx context.Context, ops []linux.Sembuf, creds *auth.Credentials, pid int32) (chan struct{}, int32, error) {
+//
+// If any operation in ops has the SEM_UNDO flag set, undoList must be
+// non-nil; the adjustment needed to reverse the operation is recorded there
+// and applied automatically when undoList.Exit is called.
+func (s *Set) ExecuteOps(ctx context.Context, ops []linux.Sembuf, creds *auth.Credentials, pid int32, undoList *SemUndoList) (chan struct{}, int32, error) {
+	// A batch that references only one semaphore is eligible for the
+	// simple, semaphore-local fast path, provided no complex waiter is
+	// pending; see Set.mu.
+	if num := singleSemHint(ops); num >= 0 {
+		s.mu.RLock()
+		if !s.dead && s.complexCount == 0 {
+			ch, retNum, err := s.executeSimpleLocked(ctx, num, ops, creds, pid, undoList)
+			s.mu.RUnlock()
+			return ch, retNum, err
+		}
+		s.mu.RUnlock()
+		// Either the set is dead or a complex waiter is pending; fall
+		// back to the exclusive path below, which handles both and
+		// preserves FIFO ordering against the complex waiter.
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.executeComplexLocked(ctx, ops, creds, pid, undoList)
+}
+
+// executeSimpleLocked is ExecuteOps' fast path for a batch whose operations
+// all reference the single semaphore num. It takes only that semaphore's
+// own lock, so it runs concurrently with operations against every other
+// semaphore in the set.
+//
+// Preconditions: s.mu is locked for reading, !s.dead, and s.complexCount == 0.
+func (s *Set) executeSimpleLocked(ctx context.Context, num int32, ops []linux.Sembuf, creds *auth.Credentials, pid int32, undoList *SemUndoList) (chan struct{}, int32, error) {
+	sem := s.findSem(num)
+	if sem == nil {
+		return nil, 0, linuxerr.EFBIG
+	}
 
+	readOnly := true
+	for _, op := range ops {
+		if op.SemOp != 0 {
+			readOnly = false
+		}
+	}
+	if !s.checkPerms(creds, fs.PermMask{Read: readOnly, Write: !readOnly}) {
+		return nil, 0, linuxerr.EACCES
+	}
+	if err := s.registry.hooks.CheckSemop(ctx, s, ops); err != nil {
+		return nil, 0, err
+	}
+
+	sem.mu.Lock()
+	defer sem.mu.Unlock()
+	return s.executeOpsLocked(ctx, ops, pid, undoList)
+}
+
+// executeComplexLocked is ExecuteOps' fallback path for a batch that spans
+// more than one semaphore, or that arrived while the set was dead or a
+// complex waiter was pending.
+//
+// Preconditions: s.mu is locked for writing.
+func (s *Set) executeComplexLocked(ctx context.Context, ops []linux.Sembuf, creds *auth.Credentials, pid int32, undoList *SemUndoList) (chan struct{}, int32, error) {
 	// Did it race with a removal operation?
 	if s.dead {
 		return nil, 0, syserror.EIDRM
@@ -592,87 +1047,365 @@ func (s *Set) ExecuteOps(ctx context.Context, ops []linux.Sembuf, creds *auth.Cr
 	if !s.checkPerms(creds, fs.PermMask{Read: readOnly, Write: !readOnly}) {
 		return nil, 0, linuxerr.EACCES
 	}
+	if err := s.registry.hooks.CheckSemop(ctx, s, ops); err != nil {
+		return nil, 0, err
+	}
+
+	return s.executeOpsLocked(ctx, ops, pid, undoList)
+}
+
+// undoAdjustmentsLocked returns list's pending adjustment slice for s and
+// whether a new, empty entry had to be allocated and linked (on both s.undo
+// and list.entries) to do so, because this is the first SEM_UNDO operation
+// against s from list. A caller that allocates a new entry but then fails to
+// commit the batch it was allocated for must unwind the link with
+// removeEmptyUndoEntryLocked, so a failed op never leaves a spurious empty
+// undo entry (and dangling set->list reference) behind.
+//
+// Preconditions: s.bookkeepingMu and list.mu are locked.
+func (s *Set) undoAdjustmentsLocked(list *SemUndoList) (adj []int16, created bool) {
+	if adj, ok := s.undo[list]; ok {
+		return adj, false
+	}
+	adj = make([]int16, s.Size())
+	if s.undo == nil {
+		s.undo = make(map[*SemUndoList][]int16)
+	}
+	s.undo[list] = adj
+	list.entries = append(list.entries, undoEntry{setID: s.ID, adjustments: adj})
+	return adj, true
+}
 
-	ch, num, err := s.executeOps(ctx, ops, pid)
+// removeEmptyUndoEntryLocked undoes the link undoAdjustmentsLocked made for
+// list against s, after a batch that would have been list's first SEM_UNDO
+// operation against s failed before it could commit.
+//
+// Preconditions: s.bookkeepingMu and list.mu are locked.
+func (s *Set) removeEmptyUndoEntryLocked(list *SemUndoList) {
+	delete(s.undo, list)
+	list.removeLocked(s.ID)
+}
+
+// executeOpsLocked is the shared core of ExecuteOps, run after permission
+// checks by both the simple and complex paths.
+//
+// Preconditions: the caller holds whatever lock(s) are necessary to safely
+// read and write every semaphore ops references; see executeSimpleLocked
+// and executeComplexLocked.
+func (s *Set) executeOpsLocked(ctx context.Context, ops []linux.Sembuf, pid int32, undoList *SemUndoList) (chan struct{}, int32, error) {
+	ok, err := s.tryExecuteLocked(ctx, ops, pid, undoList, true /* commit */)
 	if err != nil {
 		return nil, 0, err
 	}
-	return ch, num, nil
+	if ok {
+		// The change may have unblocked other pending waiters too.
+		s.retryPendingLocked(singleSemHint(ops))
+		return nil, 0, nil
+	}
+
+	// At least one operation would have to wait. Queue the whole batch so
+	// that retryPendingLocked can re-evaluate it as a unit; see the
+	// comment there for why this (rather than each semaphore tracking its
+	// waiters independently) is required for correctness.
+	w := newWaiter(ops, pid, undoList)
+	if w.complex {
+		// A complex waiter always goes on the set-wide list; a simple
+		// waiter is only ever linked into its one semaphore's own
+		// waiters list below, since that's the only list its own
+		// semaphore lock lets it safely touch.
+		s.pending.PushBack(w)
+		s.complexCount++
+	}
+	// Link at most one ref per semaphore ops references, even if ops
+	// contains more than one op against the same SemNum: tryWakeLocked
+	// resolves and removes w as a whole the first time any one of its refs
+	// is visited, so a second ref for w on the same semaphore's list would
+	// be revisited already-unlinked and wake w a second time.
+	seenSem := make(map[uint16]bool, len(ops))
+	for i := range ops {
+		if seenSem[ops[i].SemNum] {
+			continue
+		}
+		seenSem[ops[i].SemNum] = true
+		sem := &s.sems[ops[i].SemNum]
+		ref := &waiterRef{sem: sem, w: w, value: ops[i].SemOp}
+		sem.waiters.PushBack(ref)
+		w.refs = append(w.refs, ref)
+	}
+	return w.ch, int32(ops[0].SemNum), nil
 }
 
-func (s *Set) executeOps(ctx context.Context, ops []linux.Sembuf, pid int32) (chan struct{}, int32, error) {
-	// Changes to semaphores go to this slice temporarily until they all succeed.
-	tmpVals := make([]int16, len(s.sems))
-	for i := range s.sems {
-		tmpVals[i] = s.sems[i].value
+// tryExecuteLocked evaluates ops against the set's current values. If every
+// operation can proceed immediately, it returns (true, nil); when commit is
+// true it also applies the new values (and any implied SEM_UNDO
+// adjustments) and updates opTime. If at least one operation would have to
+// wait, it returns (false, nil) and never commits. A non-nil error means
+// ops can never succeed as given (overflow, or IPC_NOWAIT denied) and is
+// also never committed.
+//
+// Preconditions: the caller holds whatever lock(s) are necessary to safely
+// read and, if commit, write every semaphore ops references: either
+// Set.mu.RLock() plus that semaphore's own mu (ops is known to reference a
+// single semaphore), or Set.mu.Lock(). ctx is only consulted when commit is
+// true.
+func (s *Set) tryExecuteLocked(ctx context.Context, ops []linux.Sembuf, pid int32, undoList *SemUndoList, commit bool) (bool, error) {
+	// Changes to semaphores go to this map temporarily until they all
+	// succeed. Only semaphores ops actually references are read or
+	// written, so the simple (single-semaphore) path never touches a
+	// semaphore whose lock it doesn't hold.
+	tmpVals := make(map[uint16]int16, len(ops))
+	valueOf := func(num uint16) int16 {
+		if v, ok := tmpVals[num]; ok {
+			return v
+		}
+		return s.sems[num].value
 	}
 
 	for _, op := range ops {
-		sem := &s.sems[op.SemNum]
+		v := valueOf(op.SemNum)
 		if op.SemOp == 0 {
 			// Handle 'wait for zero' operation.
-			if tmpVals[op.SemNum] != 0 {
+			if v != 0 {
 				// Semaphore isn't 0, must wait.
 				if op.SemFlg&linux.IPC_NOWAIT != 0 {
-					return nil, 0, syserror.ErrWouldBlock
+					return false, syserror.ErrWouldBlock
 				}
-
-				w := newWaiter(op.SemOp)
-				sem.waiters.PushBack(w)
-				return w.ch, int32(op.SemNum), nil
+				return false, nil
 			}
-		} else {
-			if op.SemOp < 0 {
-				// Handle 'wait' operation.
-				if -op.SemOp > valueMax {
-					return nil, 0, syserror.ERANGE
+		} else if op.SemOp < 0 {
+			// Handle 'wait' operation.
+			if -op.SemOp > valueMax {
+				return false, syserror.ERANGE
+			}
+			if -op.SemOp > v {
+				// Not enough resources, must wait.
+				if op.SemFlg&linux.IPC_NOWAIT != 0 {
+					return false, syserror.ErrWouldBlock
 				}
-				if -op.SemOp > tmpVals[op.SemNum] {
-					// Not enough resources, must wait.
-					if op.SemFlg&linux.IPC_NOWAIT != 0 {
-						return nil, 0, syserror.ErrWouldBlock
-					}
+				return false, nil
+			}
+			tmpVals[op.SemNum] = v + op.SemOp
+		} else {
+			// op.SemOp > 0: Handle 'signal' operation.
+			if v > valueMax-op.SemOp {
+				return false, syserror.ERANGE
+			}
+			tmpVals[op.SemNum] = v + op.SemOp
+		}
+	}
 
-					w := newWaiter(op.SemOp)
-					sem.waiters.PushBack(w)
-					return w.ch, int32(op.SemNum), nil
+	if !commit {
+		return true, nil
+	}
+
+	// All operations succeeded. Apply any implied SEM_UNDO adjustments next,
+	// directly against list's live per-set slice (never a snapshot of it):
+	// the simple path only ever holds one semaphore's own lock here, so two
+	// siblings sharing undoList could be committing disjoint semaphores of
+	// the same set concurrently, and a snapshot-then-copy-back of the whole
+	// slice would let one clobber the other's adjustment to an element
+	// neither of them touched. bookkeepingMu plus undoList.mu, held for the
+	// whole check-and-apply below, makes that window disappear: only one
+	// such commit can be touching list's entry for s at a time, however many
+	// disjoint semaphores are being committed elsewhere in s concurrently.
+	if undoList != nil {
+		touchesUndo := false
+		for _, op := range ops {
+			if op.SemFlg&linux.SEM_UNDO != 0 {
+				touchesUndo = true
+				break
+			}
+		}
+		if touchesUndo {
+			s.bookkeepingMu.Lock()
+			undoList.mu.Lock()
+			adj, created := s.undoAdjustmentsLocked(undoList)
+			// Remember the prior value of every element ops touches, so an
+			// overflow partway through the batch can be unwound without
+			// disturbing adjustments this batch doesn't own.
+			var saved map[uint16]int16
+			for _, op := range ops {
+				if op.SemFlg&linux.SEM_UNDO == 0 {
+					continue
 				}
-			} else {
-				// op.SemOp > 0: Handle 'signal' operation.
-				if tmpVals[op.SemNum] > valueMax-op.SemOp {
-					return nil, 0, syserror.ERANGE
+				if saved == nil {
+					saved = make(map[uint16]int16, len(ops))
+				}
+				if _, ok := saved[op.SemNum]; !ok {
+					saved[op.SemNum] = adj[op.SemNum]
+				}
+				newAdj := int32(adj[op.SemNum]) - int32(op.SemOp)
+				if newAdj > linux.SEMAEM || newAdj < -linux.SEMAEM-1 {
+					for num, v := range saved {
+						adj[num] = v
+					}
+					if created {
+						s.removeEmptyUndoEntryLocked(undoList)
+					}
+					undoList.mu.Unlock()
+					s.bookkeepingMu.Unlock()
+					return false, syserror.ERANGE
 				}
+				adj[op.SemNum] = int16(newAdj)
 			}
-
-			tmpVals[op.SemNum] += op.SemOp
+			undoList.mu.Unlock()
+			s.bookkeepingMu.Unlock()
 		}
 	}
 
-	// All operations succeeded, apply them.
-	// TODO(gvisor.dev/issue/137): handle undo operations.
-	for i, v := range tmpVals {
-		s.sems[i].value = v
-		s.sems[i].wakeWaiters()
-		s.sems[i].pid = pid
+	// Apply the semaphore values, and the PID of every semaphore an
+	// operation referenced (even a 'wait for zero' that didn't change the
+	// value).
+	for num, v := range tmpVals {
+		s.sems[num].value = v
+	}
+	for _, op := range ops {
+		s.sems[op.SemNum].pid = pid
 	}
+	s.bookkeepingMu.Lock()
 	s.opTime = ktime.NowFromContext(ctx)
-	return nil, 0, nil
+	s.bookkeepingMu.Unlock()
+	return true, nil
+}
+
+// singleSemHint returns the semaphore number referenced by ops if they all
+// reference the same one, or -1 if ops is empty or spans more than one
+// semaphore.
+func singleSemHint(ops []linux.Sembuf) int32 {
+	if len(ops) == 0 {
+		return -1
+	}
+	num := ops[0].SemNum
+	for _, op := range ops[1:] {
+		if op.SemNum != num {
+			return -1
+		}
+	}
+	return int32(num)
+}
+
+// retryPendingLocked re-evaluates pending waiters in FIFO order after a
+// change to the set, waking every waiter whose batch can now be resolved
+// one way or another (either it would now succeed, or it would now fail
+// outright), so its owner can retry ExecuteOps and observe the real
+// outcome. Scanning stops at the first waiter that would still have to
+// block: this strict FIFO order is what gives an earlier, larger request
+// priority over a later, smaller one, fixing the starvation that Eric
+// Schenk's ipc/sem.c rewrite addressed upstream.
+//
+// If changedSem is non-negative and no pending batch spans more than one
+// semaphore (s.complexCount == 0), only changedSem's own queue is
+// rescanned, since in that case no pending batch can depend on any other
+// semaphore's value, and that queue holds only simple (single-semaphore)
+// waiters that the fast path is free to retry using only changedSem's own
+// lock. Otherwise the whole set is rescanned: the set-wide complex list is
+// retried first, in FIFO order among complex waiters, since any of them may
+// depend on a semaphore other than changedSem; then every affected
+// semaphore's own simple queue is retried.
+//
+// Preconditions: s.mu is locked for reading (plus changedSem's own mu) if
+// this is the fast path described above, or for writing otherwise.
+func (s *Set) retryPendingLocked(changedSem int32) {
+	if changedSem >= 0 && s.complexCount == 0 {
+		s.retrySimpleQueueLocked(&s.sems[changedSem])
+		return
+	}
+
+	for w := s.pending.Front(); w != nil; {
+		next := w.Next()
+		if !s.tryWakeLocked(w) {
+			break
+		}
+		w = next
+	}
+
+	if changedSem >= 0 {
+		s.retrySimpleQueueLocked(&s.sems[changedSem])
+	} else {
+		for i := range s.sems {
+			s.retrySimpleQueueLocked(&s.sems[i])
+		}
+	}
+}
+
+// retrySimpleQueueLocked retries every simple (single-semaphore) waiter
+// queued on sem, in FIFO order, stopping at the first that still has to
+// block or at the first still-blocked complex waiter (which, by FIFO
+// order, must be satisfied before anything queued behind it on this
+// semaphore, and which retryPendingLocked already gave a chance to wake via
+// the set-wide complex list before calling this).
+//
+// Preconditions: s.mu is locked for reading (plus sem's own mu) or for
+// writing.
+func (s *Set) retrySimpleQueueLocked(sem *sem) {
+	for ref := sem.waiters.Front(); ref != nil; {
+		if ref.w.complex {
+			break
+		}
+		next := ref.Next()
+		if !s.tryWakeLocked(ref.w) {
+			break
+		}
+		ref = next
+	}
+}
+
+// tryWakeLocked re-evaluates w's whole batch, without applying any change
+// to the set, and wakes it if the batch is now resolved one way or
+// another. It returns whether w was woken (and thus whether scanning
+// should continue to the next waiter).
+//
+// Preconditions: s.mu is locked.
+func (s *Set) tryWakeLocked(w *waiter) bool {
+	ok, err := s.tryExecuteLocked(nil, w.ops, w.pid, w.undoList, false /* commit */)
+	if !ok && err == nil {
+		// Still has to block.
+		return false
+	}
+	s.removeWaiterLocked(w)
+	w.ch <- struct{}{}
+	return true
+}
+
+// removeWaiterLocked unlinks w from every semaphore's per-semaphore waiters
+// list and, if w is complex, from s.pending (a simple w was never linked
+// into s.pending in the first place; see executeOpsLocked).
+//
+// Preconditions: s.mu is locked for writing, or (if w is known not to be
+// complex) for reading plus the mu of every semaphore in w.refs.
+func (s *Set) removeWaiterLocked(w *waiter) {
+	if w.complex {
+		s.pending.Remove(w)
+		s.complexCount--
+	}
+	for _, ref := range w.refs {
+		ref.sem.waiters.Remove(ref)
+	}
 }
 
 // AbortWait notifies that a waiter is giving up and will not wait on the
-// channel anymore.
-func (s *Set) AbortWait(num int32, ch chan struct{}) {
+// channel anymore. The waiter may be linked into the set-wide complex list
+// or into a single semaphore's own list, so this always takes the
+// exclusive lock rather than trying to guess which.
+func (s *Set) AbortWait(ch chan struct{}) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	sem := &s.sems[num]
-	for w := sem.waiters.Front(); w != nil; w = w.Next() {
+	for w := s.pending.Front(); w != nil; w = w.Next() {
 		if w.ch == ch {
-			sem.waiters.Remove(w)
+			s.removeWaiterLocked(w)
 			return
 		}
 	}
-	// Waiter may not be found in case it raced with wakeWaiters().
+	for i := range s.sems {
+		for ref := s.sems[i].waiters.Front(); ref != nil; ref = ref.Next() {
+			if ref.w.ch == ch {
+				s.removeWaiterLocked(ref.w)
+				return
+			}
+		}
+	}
+	// Waiter may not be found in case it raced with retryPendingLocked().
 }
 
 func (s *Set) checkCredentials(creds *auth.Credentials) bool {
@@ -703,47 +1436,95 @@ func (s *Set) checkPerms(creds *auth.Credentials, reqPerms fs.PermMask) bool {
 	return s.checkCapability(creds)
 }
 
-// destroy destroys the set.
+// destroy destroys the set. It affects every semaphore in the set, so it
+// requires the exclusive lock.
 //
-// Preconditions: Caller must hold 's.mu'.
+// Preconditions: Caller must hold 's.mu' for writing.
 func (s *Set) destroy() {
 	// Notify all waiters. They will fail on the next attempt to execute
 	// operations and return error.
 	s.dead = true
-	for _, s := range s.sems {
-		for w := s.waiters.Front(); w != nil; w = w.Next() {
-			w.ch <- struct{}{}
+	for w := s.pending.Front(); w != nil; w = w.Next() {
+		w.ch <- struct{}{}
+	}
+	s.pending.Reset()
+	s.complexCount = 0
+	// A simple waiter is only ever linked into this set via sem.waiters,
+	// but a batch that references the same semaphore more than once is
+	// only ever linked once per semaphore (see executeOpsLocked), so the
+	// seen set below is just defense in depth: each waiter's channel must
+	// only be signalled once, whatever refs it happens to have.
+	signalled := make(map[*waiter]bool)
+	for i := range s.sems {
+		for ref := s.sems[i].waiters.Front(); ref != nil; ref = ref.Next() {
+			if ref.w.complex {
+				// A complex waiter was already signalled above.
+				continue
+			}
+			if !signalled[ref.w] {
+				signalled[ref.w] = true
+				ref.w.ch <- struct{}{}
+			}
 		}
-		s.waiters.Reset()
+		s.sems[i].waiters.Reset()
 	}
-}
 
-func abs(val int16) int16 {
-	if val < 0 {
-		return -val
+	// Nobody can undo operations against a removed set anymore; scrub it
+	// from every SemUndoList that was tracking an adjustment against it.
+	s.bookkeepingMu.Lock()
+	for list := range s.undo {
+		list.mu.Lock()
+		list.removeLocked(s.ID)
+		list.mu.Unlock()
 	}
-	return val
+	s.undo = nil
+	s.bookkeepingMu.Unlock()
 }
 
-// wakeWaiters goes over all waiters and checks which of them can be notified.
-func (s *sem) wakeWaiters() {
-	// Note that this will release all waiters waiting for 0 too.
-	for w := s.waiters.Front(); w != nil; {
-		if s.value < abs(w.value) {
-			// Still blocked, skip it.
-			w = w.Next()
+// applyExitUndo applies the adjustments accumulated by an exiting
+// SemUndoList and forgets about it. Results that would go negative are
+// silently clamped to 0, matching Linux's exit_sem. The adjustments may
+// span every semaphore in the set, so this always takes the exclusive
+// lock.
+func (s *Set) applyExitUndo(ctx context.Context, list *SemUndoList, adjustments []int16, pid int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dead {
+		return
+	}
+	for i, adj := range adjustments {
+		if adj == 0 {
 			continue
 		}
-		w.ch <- struct{}{}
-		old := w
-		w = w.Next()
-		s.waiters.Remove(old)
+		v := int32(s.sems[i].value) + int32(adj)
+		if v < 0 {
+			v = 0
+		}
+		s.sems[i].value = int16(v)
+		s.sems[i].pid = pid
 	}
+	s.bookkeepingMu.Lock()
+	delete(s.undo, list)
+	s.opTime = ktime.NowFromContext(ctx)
+	s.bookkeepingMu.Unlock()
+	// The undo may have affected more than one semaphore.
+	s.retryPendingLocked(-1)
 }
 
-func newWaiter(val int16) *waiter {
+func newWaiter(ops []linux.Sembuf, pid int32, undoList *SemUndoList) *waiter {
+	complex := false
+	for _, op := range ops[1:] {
+		if op.SemNum != ops[0].SemNum {
+			complex = true
+			break
+		}
+	}
 	return &waiter{
-		value: val,
-		ch:    make(chan struct{}, 1),
+		ops:      ops,
+		pid:      pid,
+		undoList: undoList,
+		complex:  complex,
+		ch:       make(chan struct{}, 1),
 	}
 }
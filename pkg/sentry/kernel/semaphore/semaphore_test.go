@@ -0,0 +1,489 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package semaphore
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/context"
+	"gvisor.dev/gvisor/pkg/sentry/contexttest"
+	"gvisor.dev/gvisor/pkg/sentry/kernel/auth"
+	"gvisor.dev/gvisor/pkg/syserror"
+)
+
+// newTestSet creates a private set with nsems semaphores, failing t if it
+// can't.
+func newTestSet(t *testing.T, r *Registry, nsems int32) *Set {
+	t.Helper()
+	ctx := contexttest.Context(t)
+	set, err := r.FindOrCreate(ctx, linux.IPC_PRIVATE, nsems, 0600, true /* private */, true /* create */, false /* exclusive */)
+	if err != nil {
+		t.Fatalf("FindOrCreate: %v", err)
+	}
+	return set
+}
+
+// mustExecute runs ops against set and fails t unless they succeed
+// immediately, without blocking.
+func mustExecute(t *testing.T, ctx context.Context, set *Set, ops []linux.Sembuf, undoList *SemUndoList) {
+	t.Helper()
+	ch, _, err := set.ExecuteOps(ctx, ops, auth.CredentialsFromContext(ctx), 1, undoList)
+	if err != nil {
+		t.Fatalf("ExecuteOps(%+v): %v", ops, err)
+	}
+	if ch != nil {
+		t.Fatalf("ExecuteOps(%+v) blocked unexpectedly", ops)
+	}
+}
+
+func TestUndoIndependentLists(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+
+	// Two unrelated undo lists (e.g. two unrelated processes) each
+	// SEM_UNDO the same semaphore; each one's rollback must only undo its
+	// own contribution.
+	listA := NewSemUndoList()
+	listB := NewSemUndoList()
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 5, SemFlg: linux.SEM_UNDO}}, listA)
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 3, SemFlg: linux.SEM_UNDO}}, listB)
+
+	if got, err := set.GetVal(ctx, 0, creds); err != nil || got != 8 {
+		t.Fatalf("GetVal = %d, %v, want 8, nil", got, err)
+	}
+	listA.Exit(ctx, r, 1)
+	if got, err := set.GetVal(ctx, 0, creds); err != nil || got != 3 {
+		t.Fatalf("after listA.Exit: GetVal = %d, %v, want 3, nil", got, err)
+	}
+	listB.Exit(ctx, r, 1)
+	if got, err := set.GetVal(ctx, 0, creds); err != nil || got != 0 {
+		t.Fatalf("after listB.Exit: GetVal = %d, %v, want 0, nil", got, err)
+	}
+}
+
+func TestUndoSharedList(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+
+	// Two CLONE_SYSVSEM siblings share one undo list; their adjustments
+	// against the same semaphore accumulate into a single entry.
+	shared := NewSemUndoList()
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 5, SemFlg: linux.SEM_UNDO}}, shared)
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 3, SemFlg: linux.SEM_UNDO}}, shared)
+
+	if got, err := set.GetVal(ctx, 0, creds); err != nil || got != 8 {
+		t.Fatalf("GetVal = %d, %v, want 8, nil", got, err)
+	}
+	shared.Exit(ctx, r, 1)
+	if got, err := set.GetVal(ctx, 0, creds); err != nil || got != 0 {
+		t.Fatalf("after Exit: GetVal = %d, %v, want 0, nil", got, err)
+	}
+}
+
+func TestUndoOverflowLeavesValueAndAdjustmentUnchanged(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+	list := NewSemUndoList()
+
+	// -SEMAEM-1 is the most negative adjustment Linux allows; drive the
+	// adjustment there with a single signal op (undo -= SemOp).
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: linux.SEMAEM + 1, SemFlg: linux.SEM_UNDO}}, list)
+	if got := set.undo[list][0]; got != -(linux.SEMAEM + 1) {
+		t.Fatalf("undo adjustment = %d, want %d", got, -(linux.SEMAEM + 1))
+	}
+
+	// One more signal would push the adjustment past -SEMAEM-1 and must be
+	// rejected outright, without moving the semaphore value it would
+	// otherwise have changed.
+	if _, _, err := set.ExecuteOps(ctx, []linux.Sembuf{{SemNum: 0, SemOp: 1, SemFlg: linux.SEM_UNDO}}, creds, 1, list); err != syserror.ERANGE {
+		t.Fatalf("ExecuteOps = %v, want ERANGE", err)
+	}
+	if got, err := set.GetVal(ctx, 0, creds); err != nil || got != linux.SEMAEM+1 {
+		t.Fatalf("GetVal = %d, %v, want %d, nil", got, err, linux.SEMAEM+1)
+	}
+	if got := set.undo[list][0]; got != -(linux.SEMAEM + 1) {
+		t.Fatalf("undo adjustment after rejected op = %d, want unchanged %d", got, -(linux.SEMAEM + 1))
+	}
+}
+
+func TestUndoOverflowOnFirstOpLeavesNoEntry(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+	list := NewSemUndoList()
+
+	// list's very first SEM_UNDO batch against set overflows the adjustment
+	// (-SEMAEM, then -2*SEMAEM); it must not leave a spurious empty entry
+	// linked into set.undo or list.entries behind.
+	op := []linux.Sembuf{
+		{SemNum: 0, SemOp: linux.SEMAEM, SemFlg: linux.SEM_UNDO},
+		{SemNum: 0, SemOp: -linux.SEMAEM},
+		{SemNum: 0, SemOp: linux.SEMAEM, SemFlg: linux.SEM_UNDO},
+	}
+	if _, _, err := set.ExecuteOps(ctx, op, creds, 1, list); err != syserror.ERANGE {
+		t.Fatalf("ExecuteOps = %v, want ERANGE", err)
+	}
+	if _, ok := set.undo[list]; ok {
+		t.Errorf("set.undo[list] present after failed first op, want absent")
+	}
+	if len(list.entries) != 0 {
+		t.Errorf("list.entries = %+v, want empty", list.entries)
+	}
+}
+
+func TestUndoExitRemoveIDRace(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+	list := NewSemUndoList()
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 1, SemFlg: linux.SEM_UNDO}}, list)
+
+	// A set being destroyed and a task owning an outstanding undo against
+	// it exiting concurrently must not race or deadlock, however the two
+	// are interleaved; run with -race to catch a data race.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.RemoveID(ctx, set.ID, creds)
+	}()
+	go func() {
+		defer wg.Done()
+		list.Exit(ctx, r, 1)
+	}()
+	wg.Wait()
+}
+
+func TestComplexWaiterWokenByUnrelatedSemChange(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 2)
+
+	// A complex (multi-sem) batch blocks on sem 1; sem 0 already satisfies
+	// its own op. The batch is queued on the set-wide pending list, so an
+	// unrelated simple batch that signals sem 1 must fall back from the
+	// semaphore-local fast path (complexCount is nonzero) and retry that
+	// list to wake it.
+	ch, _, err := set.ExecuteOps(ctx, []linux.Sembuf{{SemNum: 0, SemOp: 0}, {SemNum: 1, SemOp: -1}}, creds, 1, nil)
+	if err != nil {
+		t.Fatalf("ExecuteOps: %v", err)
+	}
+	if ch == nil {
+		t.Fatalf("ExecuteOps didn't block")
+	}
+
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 1, SemOp: 1}}, nil)
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("complex batch was never woken after the semaphore it was blocked on changed")
+	}
+}
+
+func TestFIFOOrderPreventsStarvation(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+
+	// An earlier, larger request must be satisfied before a later, smaller
+	// one even though the smaller one could individually succeed first;
+	// otherwise the larger request can starve indefinitely.
+	chBig, _, err := set.ExecuteOps(ctx, []linux.Sembuf{{SemNum: 0, SemOp: -5}}, creds, 1, nil)
+	if err != nil {
+		t.Fatalf("ExecuteOps(big): %v", err)
+	}
+	if chBig == nil {
+		t.Fatalf("ExecuteOps(big) didn't block")
+	}
+	chSmall, _, err := set.ExecuteOps(ctx, []linux.Sembuf{{SemNum: 0, SemOp: -1}}, creds, 2, nil)
+	if err != nil {
+		t.Fatalf("ExecuteOps(small): %v", err)
+	}
+	if chSmall == nil {
+		t.Fatalf("ExecuteOps(small) didn't block")
+	}
+
+	// Enough for the small waiter alone, but not the big one.
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 2}}, nil)
+	select {
+	case <-chSmall:
+		t.Fatalf("later, smaller waiter was woken ahead of an earlier, larger one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Now enough for both; FIFO order means the big waiter goes first, but
+	// both must eventually proceed.
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 3}}, nil)
+	select {
+	case <-chBig:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("big waiter never woken")
+	}
+	select {
+	case <-chSmall:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("small waiter never woken")
+	}
+}
+
+// TestConcurrentDisjointSemOps hammers every semaphore in a set from its own
+// goroutine, exercising the fast, semaphore-local path concurrently across
+// every semaphore. Run with -race: the per-semaphore locking introduced
+// alongside the set-wide RWMutex must not let two goroutines racily update
+// different semaphores' values, pids, or bookkeeping.
+func TestConcurrentDisjointSemOps(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	const nsems = 8
+	const iterations = 500
+	set := newTestSet(t, r, nsems)
+
+	var wg sync.WaitGroup
+	for num := int32(0); num < nsems; num++ {
+		wg.Add(1)
+		go func(num int32) {
+			defer wg.Done()
+			up := []linux.Sembuf{{SemNum: uint16(num), SemOp: 1}}
+			down := []linux.Sembuf{{SemNum: uint16(num), SemOp: -1}}
+			for i := 0; i < iterations; i++ {
+				if _, _, err := set.ExecuteOps(ctx, up, creds, num, nil); err != nil {
+					t.Errorf("ExecuteOps(sem %d, +1): %v", num, err)
+					return
+				}
+				if _, _, err := set.ExecuteOps(ctx, down, creds, num, nil); err != nil {
+					t.Errorf("ExecuteOps(sem %d, -1): %v", num, err)
+					return
+				}
+			}
+		}(num)
+	}
+	wg.Wait()
+
+	for num := int32(0); num < nsems; num++ {
+		if got, err := set.GetVal(ctx, num, creds); err != nil || got != 0 {
+			t.Errorf("sem %d = %d, %v, want 0, nil", num, got, err)
+		}
+		if got, err := set.GetPID(ctx, num, creds); err != nil || got != num {
+			t.Errorf("sem %d pid = %d, %v, want %d, nil", num, got, err, num)
+		}
+	}
+}
+
+func TestIDSeqWraparound(t *testing.T) {
+	ctx := contexttest.Context(t)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	r.seq = seqMax - 1
+
+	set := newTestSet(t, r, 1)
+	if got := seqOfID(set.ID); got != 0 {
+		t.Errorf("seqOfID(%d) = %d, want 0: seq must wrap around mod seqMax rather than let idFor overflow", set.ID, got)
+	}
+}
+
+func TestStaleIDRejectedAfterIndexReuse(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+
+	set := newTestSet(t, r, 1)
+	staleID := set.ID
+	if err := r.RemoveID(ctx, staleID, creds); err != nil {
+		t.Fatalf("RemoveID: %v", err)
+	}
+
+	// The index staleID named is now free; force it to be reused by the
+	// next set.
+	reused := newTestSet(t, r, 1)
+	if indexOfID(reused.ID) != indexOfID(staleID) {
+		t.Skipf("index %d wasn't reused (got new set at index %d); nothing to check", indexOfID(staleID), indexOfID(reused.ID))
+	}
+	if reused.ID == staleID {
+		t.Fatalf("reused.ID == staleID (%d): seq must change on reuse so stale and live IDs never collide", staleID)
+	}
+
+	if got := r.FindByID(staleID); got != nil {
+		t.Errorf("FindByID(%d) = %v, want nil: a stale ID from a removed set must not resolve to whatever now occupies its old index", staleID, got)
+	}
+	if got := r.FindByID(reused.ID); got != reused {
+		t.Errorf("FindByID(%d) = %v, want %v", reused.ID, got, reused)
+	}
+}
+
+func TestHighestIndexLowersWhenTopIndexFreed(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+
+	if got := r.HighestIndex(); got != -1 {
+		t.Fatalf("HighestIndex() on empty registry = %d, want -1", got)
+	}
+
+	a := newTestSet(t, r, 1)
+	b := newTestSet(t, r, 1)
+	c := newTestSet(t, r, 1)
+	if got, want := r.HighestIndex(), indexOfID(c.ID); got != want {
+		t.Fatalf("HighestIndex() = %d, want %d", got, want)
+	}
+
+	// Removing the top index must lower HighestIndex back to the next
+	// still-live index, not leave it at a stale high-water mark.
+	if err := r.RemoveID(ctx, c.ID, creds); err != nil {
+		t.Fatalf("RemoveID(c): %v", err)
+	}
+	if got, want := r.HighestIndex(), indexOfID(b.ID); got != want {
+		t.Fatalf("HighestIndex() after removing c = %d, want %d", got, want)
+	}
+
+	if err := r.RemoveID(ctx, a.ID, creds); err != nil {
+		t.Fatalf("RemoveID(a): %v", err)
+	}
+	if got, want := r.HighestIndex(), indexOfID(b.ID); got != want {
+		t.Fatalf("HighestIndex() after removing a (not the top) = %d, want unchanged %d", got, want)
+	}
+
+	if err := r.RemoveID(ctx, b.ID, creds); err != nil {
+		t.Fatalf("RemoveID(b): %v", err)
+	}
+	if got := r.HighestIndex(); got != -1 {
+		t.Fatalf("HighestIndex() with no live sets = %d, want -1", got)
+	}
+}
+
+// TestRegistryIndexesStayConsistent creates and destroys sets with random
+// keys and checks that Registry's reverse indexes (sets, keys, the free-list
+// allocator, and highestIndex) never drift from the ground truth of which
+// sets are actually live.
+func TestRegistryIndexesStayConsistent(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	rnd := rand.New(rand.NewSource(42))
+
+	live := make(map[int32]int32) // id -> key (or IPC_PRIVATE)
+	for i := 0; i < 2000; i++ {
+		if len(live) == 0 || rnd.Intn(2) == 0 {
+			key := int32(linux.IPC_PRIVATE)
+			private := rnd.Intn(4) == 0
+			if !private {
+				key = rnd.Int31n(1 << 16)
+			}
+			set, err := r.FindOrCreate(ctx, key, 1, 0600, private, true /* create */, false /* exclusive */)
+			if err != nil {
+				continue
+			}
+			live[set.ID] = key
+			continue
+		}
+		// Remove one random live set.
+		for id := range live {
+			if err := r.RemoveID(ctx, id, creds); err != nil {
+				t.Fatalf("RemoveID(%d): %v", id, err)
+			}
+			delete(live, id)
+			break
+		}
+	}
+
+	wantHighest := int32(-1)
+	for id, key := range live {
+		if got := r.FindByID(id); got == nil || got.ID != id {
+			t.Errorf("FindByID(%d) = %v, want a set with that ID", id, got)
+		}
+		if key != linux.IPC_PRIVATE {
+			if got, err := r.FindOrCreate(ctx, key, 1, 0600, false, false /* create */, false); err != nil || got.ID != id {
+				t.Errorf("FindOrCreate(key=%d) = %v, %v, want the set with ID %d", key, got, err, id)
+			}
+		}
+		if idx := indexOfID(id); idx > wantHighest {
+			wantHighest = idx
+		}
+	}
+	if got := r.HighestIndex(); got != wantHighest {
+		t.Errorf("HighestIndex() = %d, want %d", got, wantHighest)
+	}
+}
+
+// countingHooks is a SecurityHooks that counts lifecycle callbacks and can
+// optionally deny CheckSemop, to check that Registry actually threads hook
+// invocations through the operations that are supposed to call them.
+type countingHooks struct {
+	createCount  int
+	cleanupCount int
+	denySemop    bool
+}
+
+func (h *countingHooks) Create(context.Context, *Set) error { h.createCount++; return nil }
+func (h *countingHooks) Cleanup(*Set)                       { h.cleanupCount++ }
+func (h *countingHooks) CheckAssociate(context.Context, *Set, linux.FileMode) error {
+	return nil
+}
+func (h *countingHooks) CheckSemop(ctx context.Context, set *Set, ops []linux.Sembuf) error {
+	if h.denySemop {
+		return syserror.EPERM
+	}
+	return nil
+}
+func (h *countingHooks) CheckSemctl(context.Context, *Set, int32) error { return nil }
+
+func TestSecurityHooksLifecycle(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	hooks := &countingHooks{}
+	r.SetSecurityHooks(hooks)
+
+	set := newTestSet(t, r, 1)
+	if hooks.createCount != 1 {
+		t.Errorf("createCount = %d, want 1", hooks.createCount)
+	}
+	if err := r.RemoveID(ctx, set.ID, creds); err != nil {
+		t.Fatalf("RemoveID: %v", err)
+	}
+	if hooks.cleanupCount != 1 {
+		t.Errorf("cleanupCount = %d, want 1", hooks.cleanupCount)
+	}
+}
+
+func TestSecurityHooksCanDenySemop(t *testing.T) {
+	ctx := contexttest.Context(t)
+	creds := auth.CredentialsFromContext(ctx)
+	r := NewRegistry(contexttest.RootUserNamespace)
+	set := newTestSet(t, r, 1)
+
+	r.SetSecurityHooks(&countingHooks{denySemop: true})
+	if _, _, err := set.ExecuteOps(ctx, []linux.Sembuf{{SemNum: 0, SemOp: 1}}, creds, 1, nil); err != syserror.EPERM {
+		t.Fatalf("ExecuteOps = %v, want EPERM", err)
+	}
+
+	// The no-op default must leave behavior unchanged once hooks are reset.
+	r.SetSecurityHooks(nil)
+	mustExecute(t, ctx, set, []linux.Sembuf{{SemNum: 0, SemOp: 1}}, nil)
+}